@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0077
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepInterval bounds how often Allow walks the full map set looking for
+// stale addresses to evict. Without this, an attacker rotating source
+// addresses (trivial over IPv6) would grow attempts/lastByAddr forever,
+// turning the anti-abuse check itself into an unbounded-memory DoS vector.
+const sweepInterval = time.Hour
+
+// rateLimiter tracks registration attempts so a single IP or stream can't
+// hammer registerNewUser. It's shared across every XEPRegister instance of
+// the running server, since each one only lives as long as its stream.
+type rateLimiter struct {
+	mu         sync.Mutex
+	attempts   map[string][]time.Time
+	lastByAddr map[string]time.Time
+	lastSweep  time.Time
+}
+
+var regLimiter = &rateLimiter{
+	attempts:   make(map[string][]time.Time),
+	lastByAddr: make(map[string]time.Time),
+}
+
+// Allow reports whether a new registration attempt from addr should be
+// accepted, given perHour (registrations_per_hour) and minGap
+// (min_seconds_between_attempts). A zero value disables the respective
+// check. now is injected to keep the method deterministic in tests.
+func (rl *rateLimiter) Allow(addr string, perHour int, minGap time.Duration, now time.Time) bool {
+	if len(addr) == 0 {
+		return true
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.sweep(now)
+
+	if minGap > 0 {
+		if last, ok := rl.lastByAddr[addr]; ok && now.Sub(last) < minGap {
+			return false
+		}
+	}
+	if perHour > 0 {
+		cutoff := now.Add(-time.Hour)
+		hist := rl.attempts[addr]
+		i := 0
+		for ; i < len(hist); i++ {
+			if hist[i].After(cutoff) {
+				break
+			}
+		}
+		hist = hist[i:]
+		if len(hist) >= perHour {
+			rl.attempts[addr] = hist
+			return false
+		}
+		rl.attempts[addr] = append(hist, now)
+	}
+	rl.lastByAddr[addr] = now
+	return true
+}
+
+// sweep evicts addresses that haven't been seen in over an hour, bounding
+// the maps' size to roughly the number of distinct addresses active within
+// the last sweepInterval. Callers must hold rl.mu.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < sweepInterval {
+		return
+	}
+	rl.lastSweep = now
+	cutoff := now.Add(-time.Hour)
+	for addr, last := range rl.lastByAddr {
+		if last.Before(cutoff) {
+			delete(rl.lastByAddr, addr)
+			delete(rl.attempts, addr)
+		}
+	}
+}
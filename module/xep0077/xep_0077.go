@@ -6,34 +6,97 @@
 package xep0077
 
 import (
+	"time"
+
 	"github.com/ortuman/jackal/log"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream"
 	"github.com/ortuman/jackal/stream/c2s"
 	"github.com/ortuman/jackal/xml"
 )
 
 const registerNamespace = "jabber:iq:register"
 
+const dataFormNamespace = "jabber:x:data"
+
+// registeredKey tracks, per stream, whether this connection already
+// registered an identity — kept on the stream's Context rather than a
+// struct field since it must survive even if the IQ handler were ever
+// reconstructed mid-stream.
+var registeredKey = stream.NewKey[bool]("xep0077.registered")
+
 // Config represents XMPP In-Band Registration module (XEP-0077) configuration.
 type Config struct {
 	AllowRegistration bool `yaml:"allow_registration"`
 	AllowChange       bool `yaml:"allow_change"`
 	AllowCancel       bool `yaml:"allow_cancel"`
+
+	// Form, when enabled, extends the legacy username/password fields with
+	// an ordered XEP-0004 Data Form (e.g. email, name, captcha URL, TOS
+	// acceptance) that's both advertised on the registration request and
+	// validated on submission.
+	Form FormConfig `yaml:"form"`
+
+	// RateLimit bounds how often a single connection or remote address may
+	// attempt to register an account.
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+}
+
+// FormConfig represents the registration data form configuration.
+type FormConfig struct {
+	Enabled bool        `yaml:"enabled"`
+	Fields  []FormField `yaml:"fields"`
+}
+
+// FormField represents a single field of the registration data form.
+type FormField struct {
+	Var      string `yaml:"var"`
+	Label    string `yaml:"label"`
+	Type     string `yaml:"type"`
+	Required bool   `yaml:"required"`
+}
+
+// RateLimitConfig represents the anti-abuse rate limiting configuration.
+type RateLimitConfig struct {
+	// RegistrationsPerHour caps the number of registration attempts a
+	// single remote address may make within a rolling hour. Every attempt
+	// that reaches the check counts, whether or not it ends up creating an
+	// account. Zero disables the check.
+	RegistrationsPerHour int `yaml:"registrations_per_hour"`
+
+	// MinSecondsBetweenAttempts enforces a cooldown between consecutive
+	// registration attempts from the same remote address. Zero disables
+	// the check.
+	MinSecondsBetweenAttempts int `yaml:"min_seconds_between_attempts"`
+}
+
+// RegistrationVerifier lets operators hook anti-abuse checks into the
+// registration flow. It's invoked after the submitted form passes required
+// field validation but before storage.InsertOrUpdateUser persists the user.
+type RegistrationVerifier interface {
+	// Verify inspects the submitted registration form (nil if data forms
+	// aren't enabled) and returns nil to let registration proceed. A
+	// non-nil result is sent back to the requester as-is instead — build it
+	// from iq (e.g. iq.NotAcceptableError() or iq.ResourceConstraintError())
+	// and append a redisplay of form to let the client correct its input.
+	Verify(iq *xml.IQ, form xml.XElement) *xml.IQ
 }
 
 // XEPRegister represents an in-band server stream module.
 type XEPRegister struct {
-	cfg        *Config
-	stm        c2s.Stream
-	registered bool
+	cfg      *Config
+	stm      c2s.Stream
+	verifier RegistrationVerifier
 }
 
-// New returns an in-band registration IQ handler.
-func New(config *Config, stm c2s.Stream) *XEPRegister {
+// New returns an in-band registration IQ handler. verifier may be nil if no
+// anti-abuse hook is configured.
+func New(config *Config, stm c2s.Stream, verifier RegistrationVerifier) *XEPRegister {
 	return &XEPRegister{
-		cfg: config,
-		stm: stm,
+		cfg:      config,
+		stm:      stm,
+		verifier: verifier,
 	}
 }
 
@@ -67,7 +130,8 @@ func (x *XEPRegister) ProcessIQ(iq *xml.IQ) {
 			// ...send registration fields to requester entity...
 			x.sendRegistrationFields(iq, q)
 		} else if iq.IsSet() {
-			if !x.registered {
+			registered, _ := stream.Get(x.stm.Context(), registeredKey)
+			if !registered {
 				// ...register a new user...
 				x.registerNewUser(iq, q)
 			} else {
@@ -105,10 +169,42 @@ func (x *XEPRegister) sendRegistrationFields(iq *xml.IQ, query xml.XElement) {
 	q := xml.NewElementNamespace("query", registerNamespace)
 	q.AppendElement(xml.NewElementName("username"))
 	q.AppendElement(xml.NewElementName("password"))
+	if x.cfg.Form.Enabled {
+		q.AppendElement(x.registrationForm(nil))
+	}
 	result.AppendElement(q)
 	x.stm.SendElement(result)
 }
 
+// registrationForm builds the XEP-0004 Data Form advertised alongside the
+// legacy fields. invalidVars, when non-nil, marks fields that failed
+// validation so the client can redisplay the form with highlighted errors.
+func (x *XEPRegister) registrationForm(invalidVars map[string]bool) xml.XElement {
+	form := xml.NewElementNamespace("x", dataFormNamespace)
+	form.SetAttribute("type", "form")
+
+	title := xml.NewElementName("title")
+	title.SetText("Registration")
+	form.AppendElement(title)
+
+	for _, f := range x.cfg.Form.Fields {
+		field := xml.NewElementName("field")
+		field.SetAttribute("var", f.Var)
+		field.SetAttribute("type", f.Type)
+		field.SetAttribute("label", f.Label)
+		if f.Required {
+			field.AppendElement(xml.NewElementName("required"))
+		}
+		if invalidVars[f.Var] {
+			desc := xml.NewElementName("desc")
+			desc.SetText("this field is required or was rejected")
+			field.AppendElement(desc)
+		}
+		form.AppendElement(field)
+	}
+	return form
+}
+
 func (x *XEPRegister) registerNewUser(iq *xml.IQ, query xml.XElement) {
 	userEl := query.Elements().Child("username")
 	passwordEl := query.Elements().Child("password")
@@ -116,6 +212,24 @@ func (x *XEPRegister) registerNewUser(iq *xml.IQ, query xml.XElement) {
 		x.stm.SendElement(iq.BadRequestError())
 		return
 	}
+	addr := x.stm.RemoteAddress()
+	minGap := time.Duration(x.cfg.RateLimit.MinSecondsBetweenAttempts) * time.Second
+	if !regLimiter.Allow(addr, x.cfg.RateLimit.RegistrationsPerHour, minGap, time.Now()) {
+		x.stm.SendElement(iq.ResourceConstraintError())
+		return
+	}
+
+	var form xml.XElement
+	if x.cfg.Form.Enabled {
+		form = query.Elements().ChildNamespace("x", dataFormNamespace)
+		if missing := x.missingRequiredFields(form); len(missing) > 0 {
+			errIQ := iq.NotAcceptableError()
+			errIQ.AppendElement(x.registrationForm(missing))
+			x.stm.SendElement(errIQ)
+			return
+		}
+	}
+
 	exists, err := storage.Instance().UserExists(userEl.Text())
 	if err != nil {
 		log.Errorf("%v", err)
@@ -126,6 +240,12 @@ func (x *XEPRegister) registerNewUser(iq *xml.IQ, query xml.XElement) {
 		x.stm.SendElement(iq.ConflictError())
 		return
 	}
+	if x.verifier != nil {
+		if errIQ := x.verifier.Verify(iq, form); errIQ != nil {
+			x.stm.SendElement(errIQ)
+			return
+		}
+	}
 	user := model.User{
 		Username: userEl.Text(),
 		Password: passwordEl.Text(),
@@ -136,7 +256,43 @@ func (x *XEPRegister) registerNewUser(iq *xml.IQ, query xml.XElement) {
 		return
 	}
 	x.stm.SendElement(iq.ResultIQ())
-	x.registered = true
+	stream.Set(x.stm.Context(), registeredKey, true)
+}
+
+// missingRequiredFields returns the set of configured required field vars
+// that are absent, present but empty, or — for a "boolean" field, such as a
+// TOS-acceptance checkbox — present with any value other than "1"/"true" in
+// the submitted form. A boolean field explicitly set to "false"/"0" is a
+// declined checkbox, not a satisfied one, so it's treated the same as
+// missing.
+func (x *XEPRegister) missingRequiredFields(form xml.XElement) map[string]bool {
+	missing := make(map[string]bool)
+	for _, f := range x.cfg.Form.Fields {
+		if !f.Required {
+			continue
+		}
+		var value string
+		if form != nil {
+			for _, field := range form.Elements().Children("field") {
+				if field.Attributes().Get("var") == f.Var {
+					if v := field.Elements().Child("value"); v != nil {
+						value = v.Text()
+					}
+					break
+				}
+			}
+		}
+		if f.Type == "boolean" {
+			if value != "1" && value != "true" {
+				missing[f.Var] = true
+			}
+			continue
+		}
+		if len(value) == 0 {
+			missing[f.Var] = true
+		}
+	}
+	return missing
 }
 
 func (x *XEPRegister) cancelRegistration(iq *xml.IQ, query xml.XElement) {
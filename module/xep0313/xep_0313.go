@@ -0,0 +1,241 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0313
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+)
+
+const mamNamespace = "urn:xmpp:mam:2"
+const rsmNamespace = "http://jabber.org/protocol/rsm"
+const hintsNamespace = "urn:xmpp:hints"
+const stanzaIDNamespace = "urn:xmpp:sid:0"
+
+// Config represents XEP-0313 Message Archive Management module configuration.
+type Config struct {
+	// Retention bounds how long, and how much, per-user archives are
+	// allowed to grow before PurgeExpired trims them.
+	Retention RetentionConfig `yaml:"retention"`
+}
+
+// RetentionConfig represents the MAM archive retention policy.
+type RetentionConfig struct {
+	// MaxDays is the maximum age, in days, an archived message is kept
+	// for. Zero disables the age-based bound.
+	MaxDays int `yaml:"max_days"`
+
+	// PerUserQuota is the maximum number of messages kept per user
+	// archive. Zero disables the count-based bound.
+	PerUserQuota int `yaml:"per_user_quota"`
+}
+
+// XEPMAM represents a Message Archive Management (XEP-0313) stream module.
+// Each stream gets its own instance from New, serving that stream's archive
+// queries as an ordinary IQ handler. Archiving is done by a single instance
+// bound to no stream, shared by every stream of the server, which observes
+// every stanza routed through c2s.Manager.
+type XEPMAM struct {
+	cfg *Config
+	stm c2s.Stream
+}
+
+// observerOnce makes sure only the first New call registers the archiving
+// observer, however many streams create their own XEPMAM afterwards.
+var observerOnce sync.Once
+
+// New returns a MAM module bound to stm. The first call also registers a
+// stream-independent instance as a stanza observer, so every message routed
+// through the server gets archived once.
+func New(config *Config, stm c2s.Stream) *XEPMAM {
+	observerOnce.Do(func() {
+		c2s.RegisterStanzaObserver(&XEPMAM{cfg: config})
+	})
+	return &XEPMAM{cfg: config, stm: stm}
+}
+
+// AssociatedNamespaces returns namespaces associated with the MAM module.
+func (x *XEPMAM) AssociatedNamespaces() []string {
+	return []string{mamNamespace}
+}
+
+// MatchesIQ returns whether or not an IQ should be processed by the MAM module.
+func (x *XEPMAM) MatchesIQ(iq *xml.IQ) bool {
+	return iq.Elements().ChildNamespace("query", mamNamespace) != nil
+}
+
+// ProcessIQ processes a MAM archive query, answering with the matching
+// messages wrapped as forwarded stanzas followed by a <fin/> carrying the
+// resulting XEP-0059 page info.
+func (x *XEPMAM) ProcessIQ(iq *xml.IQ) {
+	if !iq.IsSet() && !iq.IsGet() {
+		x.stm.SendElement(iq.BadRequestError())
+		return
+	}
+	query := iq.Elements().ChildNamespace("query", mamNamespace)
+
+	filters := storage.ArchiveFilters{}
+	if form := query.Elements().ChildNamespace("x", "jabber:x:data"); form != nil {
+		for _, field := range form.Elements().Children("field") {
+			v := field.Elements().Child("value")
+			if v == nil {
+				continue
+			}
+			switch field.Attributes().Get("var") {
+			case "start":
+				if t, err := time.Parse(time.RFC3339, v.Text()); err == nil {
+					filters.Start = &t
+				}
+			case "end":
+				if t, err := time.Parse(time.RFC3339, v.Text()); err == nil {
+					filters.End = &t
+				}
+			case "with":
+				if j, err := xml.NewJIDString(v.Text(), false); err == nil {
+					filters.With = j
+				}
+			}
+		}
+	}
+
+	rsm := storage.RSMRequest{}
+	if set := query.Elements().ChildNamespace("set", rsmNamespace); set != nil {
+		if max := set.Elements().Child("max"); max != nil {
+			rsm.Max, _ = strconv.Atoi(max.Text())
+		}
+		if after := set.Elements().Child("after"); after != nil {
+			rsm.After = after.Text()
+		}
+		if before := set.Elements().Child("before"); before != nil {
+			rsm.Before = before.Text()
+		}
+	}
+
+	archiveID := x.stm.Username()
+	stanzas, rsmRes, err := storage.ArchiveInstance().QueryArchive(archiveID, filters, rsm)
+	if err != nil {
+		log.Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	queryID := query.Attributes().Get("queryid")
+	for _, as := range stanzas {
+		x.stm.SendElement(forwardedResult(mamNamespace, queryID, as))
+	}
+
+	result := iq.ResultIQ()
+	fin := xml.NewElementNamespace("fin", mamNamespace)
+	set := xml.NewElementNamespace("set", rsmNamespace)
+	if len(rsmRes.First) > 0 {
+		first := xml.NewElementName("first")
+		first.SetText(rsmRes.First)
+		set.AppendElement(first)
+	}
+	if len(rsmRes.Last) > 0 {
+		last := xml.NewElementName("last")
+		last.SetText(rsmRes.Last)
+		set.AppendElement(last)
+	}
+	count := xml.NewElementName("count")
+	count.SetText(strconv.Itoa(rsmRes.Count))
+	set.AppendElement(count)
+	fin.AppendElement(set)
+	result.AppendElement(fin)
+	x.stm.SendElement(result)
+}
+
+// ObserveStanza archives a copy of every message stanza routed through the
+// server — under both the recipient's and the sender's own archive, so a
+// user querying their own MAM history finds messages they sent as well as
+// received — tagging each copy with its own XEP-0359 stanza id, unless the
+// sender requested <no-store/> (XEP-0334). Only the recipient's archive id
+// is attached to the stanza actually delivered, since that's the one a
+// XEP-0359-aware client correlates against its own MAM queries.
+func (x *XEPMAM) ObserveStanza(elem xml.Stanza) {
+	msg, ok := elem.(*xml.Message)
+	if !ok {
+		return
+	}
+	if msg.Elements().ChildNamespace("no-store", hintsNamespace) != nil {
+		return
+	}
+	ts := time.Now()
+
+	recipientID := msg.ToJID().ToBareJID().Node()
+	recipientStanzaID, archived := x.archiveUnder(recipientID, msg, ts)
+
+	if senderID := msg.FromJID().ToBareJID().Node(); senderID != recipientID {
+		x.archiveUnder(senderID, msg, ts)
+	}
+
+	if archived {
+		sid := xml.NewElementNamespace("stanza-id", stanzaIDNamespace)
+		sid.SetAttribute("id", recipientStanzaID)
+		sid.SetAttribute("by", recipientID)
+		msg.AppendElement(sid)
+	}
+}
+
+// archiveUnder reserves an id for archiveID, tags a clone of msg with it,
+// and persists that clone — so the archived raw_xml carries its own
+// stanza-id, and mutating the clone never reaches the stanza actually
+// delivered. It returns the reserved id and whether archiving succeeded.
+func (x *XEPMAM) archiveUnder(archiveID string, msg *xml.Message, ts time.Time) (string, bool) {
+	stanzaID, err := storage.ArchiveInstance().NextArchiveID(archiveID, ts)
+	if err != nil {
+		log.Error(err)
+		return "", false
+	}
+	clone, err := xml.NewMessageFromString(msg.String())
+	if err != nil {
+		log.Error(err)
+		return "", false
+	}
+	sid := xml.NewElementNamespace("stanza-id", stanzaIDNamespace)
+	sid.SetAttribute("id", stanzaID)
+	sid.SetAttribute("by", archiveID)
+	clone.AppendElement(sid)
+
+	if err := storage.ArchiveInstance().ArchiveMessage(archiveID, stanzaID, clone, ts); err != nil {
+		log.Error(err)
+		return "", false
+	}
+	return stanzaID, true
+}
+
+// PurgeExpired enforces the configured retention policy against archiveID,
+// dropping entries older than Retention.MaxDays and trimming the oldest
+// ones past Retention.PerUserQuota. Intended to be invoked periodically by
+// the server's housekeeping routine.
+func (x *XEPMAM) PurgeExpired(archiveID string) error {
+	var maxAge time.Duration
+	if x.cfg.Retention.MaxDays > 0 {
+		maxAge = time.Duration(x.cfg.Retention.MaxDays) * 24 * time.Hour
+	}
+	return storage.ArchiveInstance().PurgeArchive(archiveID, maxAge, x.cfg.Retention.PerUserQuota)
+}
+
+func forwardedResult(ns, queryID string, as storage.ArchivedStanza) xml.XElement {
+	result := xml.NewElementNamespace("result", ns)
+	if len(queryID) > 0 {
+		result.SetAttribute("queryid", queryID)
+	}
+	result.SetAttribute("id", as.ID)
+
+	forwarded := xml.NewElementNamespace("forwarded", "urn:xmpp:forward:0")
+	delay := xml.NewElementNamespace("delay", "urn:xmpp:delay")
+	delay.SetAttribute("stamp", as.Timestamp.UTC().Format(time.RFC3339))
+	forwarded.AppendElement(delay)
+	forwarded.AppendElement(as.Stanza)
+	result.AppendElement(forwarded)
+	return result
+}
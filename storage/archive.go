@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/xml"
+)
+
+// ArchiveStorage defines the persistence contract for XEP-0313 Message
+// Archive Management. archiveID identifies the owning archive — typically
+// a bare JID's node — and is opaque to callers beyond that.
+type ArchiveStorage interface {
+	// NextArchiveID reserves and returns the id the next ArchiveMessage
+	// call for archiveID at ts will store a message under, letting callers
+	// tag a stanza with its own eventual archive id before persisting it.
+	NextArchiveID(archiveID string, ts time.Time) (stanzaID string, err error)
+
+	// ArchiveMessage persists stanza under archiveID using stanzaID, as
+	// previously reserved by NextArchiveID.
+	ArchiveMessage(archiveID, stanzaID string, stanza *xml.Message, ts time.Time) error
+
+	// QueryArchive returns the stanzas in archiveID matching filters,
+	// paginated according to rsm, alongside the resulting RSM page info.
+	QueryArchive(archiveID string, filters ArchiveFilters, rsm RSMRequest) ([]ArchivedStanza, RSMResult, error)
+
+	// PurgeArchive deletes every entry in archiveID older than maxAge, and,
+	// if quota is greater than zero, trims the oldest entries exceeding it.
+	// Either bound may be disabled by passing zero.
+	PurgeArchive(archiveID string, maxAge time.Duration, quota int) error
+}
+
+// ArchiveFilters narrows a QueryArchive call to a date range and/or
+// correspondent JID, mirroring the fields XEP-0313 allows in its query
+// form (start, end, with).
+type ArchiveFilters struct {
+	Start *time.Time
+	End   *time.Time
+	With  *xml.JID
+}
+
+// ArchivedStanza represents a single archived message alongside the
+// metadata XEP-0313 returns it with.
+type ArchivedStanza struct {
+	ID        string
+	Stanza    *xml.Message
+	Timestamp time.Time
+}
+
+// RSMRequest carries the XEP-0059 Result Set Management parameters a
+// client submitted alongside an archive query.
+type RSMRequest struct {
+	Max    int
+	After  string
+	Before string
+}
+
+// RSMResult carries the XEP-0059 page info QueryArchive answered a request
+// with, to be echoed back in the <fin/> response.
+type RSMResult struct {
+	First string
+	Last  string
+	Count int
+}
+
+var (
+	archiveInst   ArchiveStorage
+	archiveInstMu sync.RWMutex
+)
+
+// InitializeArchive registers the ArchiveStorage backend — sql.NewArchive
+// or bolt.NewArchive, typically — used to persist XEP-0313 archives.
+func InitializeArchive(backend ArchiveStorage) {
+	archiveInstMu.Lock()
+	defer archiveInstMu.Unlock()
+	archiveInst = backend
+}
+
+// ArchiveInstance returns the configured ArchiveStorage backend.
+func ArchiveInstance() ArchiveStorage {
+	archiveInstMu.RLock()
+	defer archiveInstMu.RUnlock()
+
+	if archiveInst == nil {
+		log.Fatalf("archive storage not initialized")
+	}
+	return archiveInst
+}
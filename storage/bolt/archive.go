@@ -0,0 +1,259 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/xml"
+)
+
+// archiveBucket holds every archived message, keyed by
+// archiveID + big-endian timestamp + sequence so a bucket range scan
+// yields results in chronological order.
+var archiveBucket = []byte("archives")
+
+// Archive is a BoltDB-backed storage.ArchiveStorage implementation.
+type Archive struct {
+	db *bolt.DB
+}
+
+// NewArchive returns a BoltDB archive storage backed by db, creating the
+// archives bucket if it doesn't exist yet.
+func NewArchive(db *bolt.DB) (*Archive, error) {
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(archiveBucket)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return &Archive{db: db}, nil
+}
+
+func archiveKey(archiveID string, ts time.Time, seq uint32) []byte {
+	key := make([]byte, len(archiveID)+1+8+4)
+	n := copy(key, archiveID)
+	key[n] = '\x00'
+	binary.BigEndian.PutUint64(key[n+1:], uint64(ts.UnixNano()))
+	binary.BigEndian.PutUint32(key[n+9:], seq)
+	return key
+}
+
+// NextArchiveID reserves and returns the hex-encoded key the next
+// ArchiveMessage call for archiveID at ts will store a message under,
+// letting callers tag a stanza with its own eventual archive id before
+// persisting it.
+func (a *Archive) NextArchiveID(archiveID string, ts time.Time) (string, error) {
+	var key []byte
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		seq, err := tx.Bucket(archiveBucket).NextSequence()
+		if err != nil {
+			return err
+		}
+		key = archiveKey(archiveID, ts, uint32(seq))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", key), nil
+}
+
+// ArchiveMessage persists stanza under archiveID using stanzaID, as
+// previously reserved by NextArchiveID.
+func (a *Archive) ArchiveMessage(archiveID, stanzaID string, stanza *xml.Message, ts time.Time) error {
+	key, err := hex.DecodeString(stanzaID)
+	if err != nil {
+		return err
+	}
+	if !hasPrefix(key, append([]byte(archiveID), '\x00')) {
+		return fmt.Errorf("bolt: stanza id %s was not reserved for archive %s", stanzaID, archiveID)
+	}
+	value := stanza.ToJID().ToBareJID().String() + "\x00" + stanza.String()
+	return a.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(archiveBucket).Put(key, []byte(value))
+	})
+}
+
+// QueryArchive returns the stanzas in archiveID matching filters, paginated
+// according to rsm.
+func (a *Archive) QueryArchive(archiveID string, filters storage.ArchiveFilters, rsm storage.RSMRequest) ([]storage.ArchivedStanza, storage.RSMResult, error) {
+	var ret []storage.ArchivedStanza
+	prefix := append([]byte(archiveID), '\x00')
+
+	var afterKey, beforeKey []byte
+	if len(rsm.After) > 0 {
+		afterKey, _ = hex.DecodeString(rsm.After)
+	}
+	if len(rsm.Before) > 0 {
+		beforeKey, _ = hex.DecodeString(rsm.Before)
+	}
+
+	// total counts every entry matching filters regardless of pagination —
+	// what XEP-0059 <count/> is supposed to report — via its own full scan
+	// that ignores rsm.After/Before/Max entirely.
+	var total int
+
+	err := a.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(archiveBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && hasPrefix(k, prefix); k, v = c.Next() {
+			ts := time.Unix(0, int64(binary.BigEndian.Uint64(k[len(prefix):len(prefix)+8])))
+			if filters.Start != nil && ts.Before(*filters.Start) {
+				continue
+			}
+			if filters.End != nil && ts.After(*filters.End) {
+				continue
+			}
+			withJID, _, err := splitArchiveValue(v)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			if filters.With != nil && withJID != filters.With.ToBareJID().String() {
+				continue
+			}
+			total++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, storage.RSMResult{}, err
+	}
+
+	matches := func(k, v []byte) (storage.ArchivedStanza, bool) {
+		ts := time.Unix(0, int64(binary.BigEndian.Uint64(k[len(prefix):len(prefix)+8])))
+		if filters.Start != nil && ts.Before(*filters.Start) {
+			return storage.ArchivedStanza{}, false
+		}
+		if filters.End != nil && ts.After(*filters.End) {
+			return storage.ArchivedStanza{}, false
+		}
+		withJID, rawXML, err := splitArchiveValue(v)
+		if err != nil {
+			log.Error(err)
+			return storage.ArchivedStanza{}, false
+		}
+		if filters.With != nil && withJID != filters.With.ToBareJID().String() {
+			return storage.ArchivedStanza{}, false
+		}
+		msg, err := xml.NewMessageFromString(rawXML)
+		if err != nil {
+			log.Error(err)
+			return storage.ArchivedStanza{}, false
+		}
+		return storage.ArchivedStanza{ID: fmt.Sprintf("%x", k), Stanza: msg, Timestamp: ts}, true
+	}
+
+	err = a.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(archiveBucket).Cursor()
+		if beforeKey != nil {
+			// <before> must return the Max entries immediately preceding
+			// the anchor, not the oldest Max entries that precede it, so
+			// this scans backward from the anchor and the result is
+			// reversed back to ascending order below — a forward scan
+			// capped at Max would instead yield the oldest page.
+			k, v := c.Seek(beforeKey)
+			if k == nil {
+				k, v = c.Last()
+			}
+			if k != nil && bytes.Compare(k, beforeKey) >= 0 {
+				k, v = c.Prev()
+			}
+			for ; k != nil && hasPrefix(k, prefix); k, v = c.Prev() {
+				if afterKey != nil && bytes.Compare(k, afterKey) <= 0 {
+					break
+				}
+				if as, ok := matches(k, v); ok {
+					ret = append(ret, as)
+					if rsm.Max > 0 && len(ret) >= rsm.Max {
+						break
+					}
+				}
+			}
+			for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+				ret[i], ret[j] = ret[j], ret[i]
+			}
+			return nil
+		}
+		for k, v := c.Seek(prefix); k != nil && hasPrefix(k, prefix); k, v = c.Next() {
+			if afterKey != nil && bytes.Compare(k, afterKey) <= 0 {
+				continue
+			}
+			if as, ok := matches(k, v); ok {
+				ret = append(ret, as)
+				if rsm.Max > 0 && len(ret) >= rsm.Max {
+					break
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, storage.RSMResult{}, err
+	}
+	res := storage.RSMResult{Count: total}
+	if len(ret) > 0 {
+		res.First = ret[0].ID
+		res.Last = ret[len(ret)-1].ID
+	}
+	return ret, res, nil
+}
+
+// PurgeArchive deletes every entry in archiveID older than maxAge and, if
+// quota is greater than zero, trims the oldest entries exceeding it.
+func (a *Archive) PurgeArchive(archiveID string, maxAge time.Duration, quota int) error {
+	prefix := append([]byte(archiveID), '\x00')
+	cutoff := time.Time{}
+	if maxAge > 0 {
+		cutoff = time.Now().Add(-maxAge)
+	}
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(archiveBucket)
+		c := b.Cursor()
+
+		var keys [][]byte
+		for k, _ := c.Seek(prefix); k != nil && hasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for _, k := range keys {
+			ts := time.Unix(0, int64(binary.BigEndian.Uint64(k[len(prefix):len(prefix)+8])))
+			if maxAge > 0 && ts.Before(cutoff) {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		if quota > 0 && len(keys) > quota {
+			for _, k := range keys[:len(keys)-quota] {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func hasPrefix(b, prefix []byte) bool {
+	return len(b) >= len(prefix) && string(b[:len(prefix)]) == string(prefix)
+}
+
+func splitArchiveValue(v []byte) (withJID, rawXML string, err error) {
+	for i, c := range v {
+		if c == '\x00' {
+			return string(v[:i]), string(v[i+1:]), nil
+		}
+	}
+	return "", "", fmt.Errorf("bolt: malformed archive entry")
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package sql
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/xml"
+)
+
+// Archive is a SQL-backed storage.ArchiveStorage implementation.
+type Archive struct {
+	db *sql.DB
+}
+
+// NewArchive returns a SQL archive storage backed by db. The caller owns
+// db's lifecycle.
+func NewArchive(db *sql.DB) *Archive {
+	return &Archive{db: db}
+}
+
+// NextArchiveID reserves and returns the id the next ArchiveMessage call
+// for archiveID at ts will store a message under. Ids are a hex-encoded
+// timestamp plus a random suffix, kept lexicographically sortable so the
+// existing id < / id > pagination comparisons in QueryArchive stay
+// chronological.
+func (a *Archive) NextArchiveID(archiveID string, ts time.Time) (string, error) {
+	var suffix [4]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return "", err
+	}
+	key := make([]byte, 12)
+	binary.BigEndian.PutUint64(key, uint64(ts.UnixNano()))
+	copy(key[8:], suffix[:])
+	return hex.EncodeToString(key), nil
+}
+
+// ArchiveMessage persists stanza under archiveID using stanzaID, as
+// previously reserved by NextArchiveID.
+func (a *Archive) ArchiveMessage(archiveID, stanzaID string, stanza *xml.Message, ts time.Time) error {
+	_, err := a.db.Exec(`
+		INSERT INTO archives (id, archive_id, with_jid, raw_xml, created_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		stanzaID, archiveID, stanza.ToJID().ToBareJID().String(), stanza.String(), ts,
+	)
+	return err
+}
+
+// QueryArchive returns the stanzas in archiveID matching filters, paginated
+// according to rsm.
+func (a *Archive) QueryArchive(archiveID string, filters storage.ArchiveFilters, rsm storage.RSMRequest) ([]storage.ArchivedStanza, storage.RSMResult, error) {
+	whereClause := ` WHERE archive_id = ?`
+	whereArgs := []interface{}{archiveID}
+
+	if filters.Start != nil {
+		whereClause += ` AND created_at >= ?`
+		whereArgs = append(whereArgs, *filters.Start)
+	}
+	if filters.End != nil {
+		whereClause += ` AND created_at <= ?`
+		whereArgs = append(whereArgs, *filters.End)
+	}
+	if filters.With != nil {
+		whereClause += ` AND with_jid = ?`
+		whereArgs = append(whereArgs, filters.With.ToBareJID().String())
+	}
+
+	// total is the count of every entry matching the filters regardless of
+	// pagination — what XEP-0059 <count/> is supposed to report — so it's
+	// queried independently of the LIMIT/after/before-bounded page below.
+	var total int
+	if err := a.db.QueryRow(`SELECT COUNT(*) FROM archives`+whereClause, whereArgs...).Scan(&total); err != nil {
+		return nil, storage.RSMResult{}, err
+	}
+
+	// <before> must return the Max entries immediately preceding the
+	// anchor, not the oldest Max entries that precede it, so that page is
+	// fetched newest-first and reversed below rather than sharing the
+	// ascending order <after> pages use.
+	paging := len(rsm.Before) > 0
+
+	q := `SELECT id, raw_xml, created_at FROM archives` + whereClause
+	args := append([]interface{}{}, whereArgs...)
+	if len(rsm.After) > 0 {
+		q += ` AND id > ?`
+		args = append(args, rsm.After)
+	}
+	if paging {
+		q += ` AND id < ?`
+		args = append(args, rsm.Before)
+	}
+	if paging {
+		q += ` ORDER BY created_at DESC`
+	} else {
+		q += ` ORDER BY created_at ASC`
+	}
+	if rsm.Max > 0 {
+		q += ` LIMIT ?`
+		args = append(args, rsm.Max)
+	}
+
+	rows, err := a.db.Query(q, args...)
+	if err != nil {
+		return nil, storage.RSMResult{}, err
+	}
+	defer rows.Close()
+
+	var ret []storage.ArchivedStanza
+	for rows.Next() {
+		var id string
+		var rawXML string
+		var createdAt time.Time
+		if err := rows.Scan(&id, &rawXML, &createdAt); err != nil {
+			return nil, storage.RSMResult{}, err
+		}
+		msg, err := xml.NewMessageFromString(rawXML)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		ret = append(ret, storage.ArchivedStanza{ID: id, Stanza: msg, Timestamp: createdAt})
+	}
+	if paging {
+		for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+			ret[i], ret[j] = ret[j], ret[i]
+		}
+	}
+	res := storage.RSMResult{Count: total}
+	if len(ret) > 0 {
+		res.First = ret[0].ID
+		res.Last = ret[len(ret)-1].ID
+	}
+	return ret, res, nil
+}
+
+// PurgeArchive deletes every entry in archiveID older than maxAge and, if
+// quota is greater than zero, trims the oldest entries exceeding it.
+func (a *Archive) PurgeArchive(archiveID string, maxAge time.Duration, quota int) error {
+	if maxAge > 0 {
+		cutoff := time.Now().Add(-maxAge)
+		if _, err := a.db.Exec(`DELETE FROM archives WHERE archive_id = ? AND created_at < ?`, archiveID, cutoff); err != nil {
+			return err
+		}
+	}
+	if quota > 0 {
+		if _, err := a.db.Exec(`
+			DELETE FROM archives
+			WHERE archive_id = ? AND id NOT IN (
+				SELECT id FROM archives WHERE archive_id = ? ORDER BY created_at DESC LIMIT ?
+			)`, archiveID, archiveID, quota); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -33,6 +33,11 @@ var (
 	// ErrBlockedJID will be returned by Route method if
 	// destination JID matches any of the user's blocked JID.
 	ErrBlockedJID = errors.New("c2s: destination jid is blocked")
+
+	// ErrStreamNotResumable will be returned by ResumeStream method if
+	// no resumable session is held under the given previd, either because
+	// it never existed or its hold timer already expired.
+	ErrStreamNotResumable = errors.New("c2s: stream is not resumable")
 )
 
 // Stream represents a client-to-server XMPP stream.
@@ -47,6 +52,11 @@ type Stream interface {
 
 	JID() *xml.JID
 
+	// RemoteAddress returns the IP address of the underlying connection,
+	// stripped of its port. Modules use it for anti-abuse purposes such as
+	// per-IP rate limiting.
+	RemoteAddress() string
+
 	IsSecured() bool
 	IsAuthenticated() bool
 	IsCompressed() bool
@@ -57,39 +67,64 @@ type Stream interface {
 	Disconnect(err error)
 }
 
-// Manager manages the sessions associated with an account.
+// Manager manages the sessions associated with an account on this single
+// node. It's the in-memory Router backend used when the server runs
+// standalone; ClusterRouter composes it to add cluster-wide awareness.
 type Manager struct {
 	cfg        *Config
 	lock       sync.RWMutex
 	stms       map[string]Stream
 	authedStms map[string][]Stream
 	blockLists map[string][]*xml.JID
+	smSessions map[string]*smSession
+	resumable  map[string]*smSession
 }
 
 // singleton interface
 var (
-	inst        *Manager
+	inst        Router
 	instMu      sync.RWMutex
 	initialized uint32
 )
 
-// Initialize initializes the c2s session manager.
+func newManager(cfg *Config) *Manager {
+	return &Manager{
+		cfg:        cfg,
+		stms:       make(map[string]Stream),
+		authedStms: make(map[string][]Stream),
+		blockLists: make(map[string][]*xml.JID),
+		smSessions: make(map[string]*smSession),
+		resumable:  make(map[string]*smSession),
+	}
+}
+
+// Initialize initializes the c2s session manager with a single-node,
+// in-memory routing backend. Use InitializeCluster instead when running
+// more than one node against the same domains.
 func Initialize(cfg *Config) {
 	if atomic.CompareAndSwapUint32(&initialized, 0, 1) {
 		instMu.Lock()
 		defer instMu.Unlock()
 
-		inst = &Manager{
-			cfg:        cfg,
-			stms:       make(map[string]Stream),
-			authedStms: make(map[string][]Stream),
-			blockLists: make(map[string][]*xml.JID),
-		}
+		inst = newManager(cfg)
 	}
 }
 
-// Instance returns the c2s session manager instance.
-func Instance() *Manager {
+// InitializeCluster initializes the c2s session manager with a
+// cluster-aware routing backend: local delivery still goes straight to the
+// in-memory streams, while anything hosted on another node is handed to
+// forwarder once presence has located it through store.
+func InitializeCluster(cfg *Config, nodeID string, store PresenceStore, forwarder NodeForwarder) {
+	if atomic.CompareAndSwapUint32(&initialized, 0, 1) {
+		instMu.Lock()
+		defer instMu.Unlock()
+
+		inst = NewClusterRouter(cfg, nodeID, store, forwarder)
+	}
+}
+
+// Instance returns the c2s routing backend instance.
+func Instance() Router {
 	instMu.RLock()
 	defer instMu.RUnlock()
 
@@ -152,6 +187,9 @@ func (m *Manager) UnregisterStream(stm Stream) error {
 		m.lock.Unlock()
 		return fmt.Errorf("stream not found: %s", stm.ID())
 	}
+	sess := m.smSessions[stm.ID()]
+	delete(m.smSessions, stm.ID())
+
 	if authedStms := m.authedStms[stm.Username()]; authedStms != nil {
 		res := stm.Resource()
 		for i := 0; i < len(authedStms); i++ {
@@ -167,6 +205,11 @@ func (m *Manager) UnregisterStream(stm Stream) error {
 		}
 	}
 	delete(m.stms, stm.ID())
+
+	if sess != nil && m.cfg.StreamManagement.ResumeTimeout > 0 {
+		// defer eviction so the session can still be reclaimed via ResumeStream
+		m.holdForResumption(sess)
+	}
 	m.lock.Unlock()
 	log.Infof("unregistered stream... (id: %s)", stm.ID())
 	return nil
@@ -255,9 +298,24 @@ func (m *Manager) StreamsMatchingJID(jid *xml.JID) []Stream {
 	return ret
 }
 
+// ResourcesMatchingJID returns every local resource matching jid. On a
+// single-node Manager this is the same set StreamsMatchingJID returns,
+// since there's nowhere else to look.
+func (m *Manager) ResourcesMatchingJID(jid *xml.JID) ([]*xml.JID, error) {
+	stms := m.StreamsMatchingJID(jid)
+	ret := make([]*xml.JID, len(stms))
+	for i, stm := range stms {
+		ret[i] = stm.JID()
+	}
+	return ret, nil
+}
+
 func (m *Manager) route(elem xml.Stanza, ignoreBlocking bool) error {
 	toJID := elem.ToJID()
 	if !m.IsLocalDomain(toJID.Domain()) {
+		if s2sRouter != nil {
+			return s2sRouter.Route(elem)
+		}
 		return nil
 	}
 	if !ignoreBlocking && !toJID.IsServer() {
@@ -265,6 +323,8 @@ func (m *Manager) route(elem xml.Stanza, ignoreBlocking bool) error {
 			return ErrBlockedJID
 		}
 	}
+	notifyObservers(elem)
+
 	rcps := m.StreamsMatchingJID(toJID.ToBareJID())
 	if len(rcps) == 0 {
 		exists, err := storage.Instance().UserExists(toJID.Node())
@@ -0,0 +1,304 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package c2s
+
+import (
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/xml"
+)
+
+// ClusterRouter is a Router backend that extends a local Manager with a
+// PresenceStore shared across every node in the cluster, so routing
+// decisions account for resources authenticated elsewhere. Local delivery
+// stays direct; everything else is handed to a NodeForwarder.
+type ClusterRouter struct {
+	nodeID    string
+	local     *Manager
+	presence  PresenceStore
+	forwarder NodeForwarder
+}
+
+// NewClusterRouter returns a cluster-aware Router backend. nodeID identifies
+// this process within the cluster and is published alongside every
+// presence entry this node owns.
+func NewClusterRouter(cfg *Config, nodeID string, presence PresenceStore, forwarder NodeForwarder) *ClusterRouter {
+	return &ClusterRouter{
+		nodeID:    nodeID,
+		local:     newManager(cfg),
+		presence:  presence,
+		forwarder: forwarder,
+	}
+}
+
+// DefaultLocalDomain returns default local domain.
+func (r *ClusterRouter) DefaultLocalDomain() string {
+	return r.local.DefaultLocalDomain()
+}
+
+// IsLocalDomain returns true if domain is a local server domain.
+func (r *ClusterRouter) IsLocalDomain(domain string) bool {
+	return r.local.IsLocalDomain(domain)
+}
+
+// RegisterStream registers stm with this node's local state. Its presence
+// isn't published cluster-wide until it authenticates.
+func (r *ClusterRouter) RegisterStream(stm Stream) error {
+	return r.local.RegisterStream(stm)
+}
+
+// UnregisterStream unregisters stm locally and withdraws its cluster-wide
+// presence entry so other nodes stop routing to it.
+func (r *ClusterRouter) UnregisterStream(stm Stream) error {
+	if err := r.local.UnregisterStream(stm); err != nil {
+		return err
+	}
+	if len(stm.Resource()) == 0 {
+		return nil
+	}
+	if err := r.presence.Remove(stm.Username(), stm.Resource()); err != nil {
+		log.Error(err)
+	}
+	return nil
+}
+
+// AuthenticateStream authenticates stm locally and publishes its presence
+// so StreamsMatchingJID/ResourcesMatchingJID on other nodes can route to
+// it.
+func (r *ClusterRouter) AuthenticateStream(stm Stream) error {
+	if err := r.local.AuthenticateStream(stm); err != nil {
+		return err
+	}
+	var priority int8
+	if p := stm.Presence(); p != nil {
+		priority = p.Priority()
+	}
+	if err := r.presence.Put(stm.Username(), stm.Resource(), r.nodeID, priority); err != nil {
+		log.Error(err)
+	}
+	return nil
+}
+
+// IsBlockedJID returns whether or not the passed jid matches any of a
+// user's blocking list JID, consulting this node's cache.
+func (r *ClusterRouter) IsBlockedJID(jid *xml.JID, username string) bool {
+	return r.local.IsBlockedJID(jid, username)
+}
+
+// ReloadBlockList reloads the block list on this node and calls the
+// presence store's Invalidate for username. The block list caches kept by
+// other nodes' Managers are not cleared by this call.
+func (r *ClusterRouter) ReloadBlockList(username string) {
+	r.local.ReloadBlockList(username)
+	r.presence.Invalidate(username)
+}
+
+// Route routes a stanza applying server rules for handling XML stanzas,
+// forwarding to the owning node when the destination isn't hosted here.
+func (r *ClusterRouter) Route(elem xml.Stanza) error {
+	return r.route(elem, false)
+}
+
+// MustRoute routes a stanza applying server rules for handling XML stanzas
+// and ignoring blocking lists.
+func (r *ClusterRouter) MustRoute(elem xml.Stanza) error {
+	return r.route(elem, true)
+}
+
+// StreamsMatchingJID returns the available Stream handles hosted on this
+// node that match a given JID. A Stream can only ever represent a local
+// connection, so this deliberately does not reach across nodes — use
+// ResourcesMatchingJID for a cluster-wide presence probe that doesn't need
+// to SendElement to what it finds.
+func (r *ClusterRouter) StreamsMatchingJID(jid *xml.JID) []Stream {
+	return r.local.StreamsMatchingJID(jid)
+}
+
+// ResourcesMatchingJID returns every resource matching jid across the whole
+// cluster, combining this node's local streams with presence entries
+// published by other nodes. Unlike StreamsMatchingJID, it's safe to use for
+// presence probes that need a complete, cluster-wide picture.
+func (r *ClusterRouter) ResourcesMatchingJID(jid *xml.JID) ([]*xml.JID, error) {
+	var ret []*xml.JID
+	for _, stm := range r.local.StreamsMatchingJID(jid) {
+		ret = append(ret, stm.JID())
+	}
+	entries, err := r.presence.Lookup(jid.Node(), jid.Resource())
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range r.excludeLocalNode(entries) {
+		ret = append(ret, entry.JID)
+	}
+	return ret, nil
+}
+
+// EnableStreamManagement activates XEP-0198 stream management for stm on
+// this node. See the Router interface doc for the clustering limitation:
+// the resulting session can only be resumed against this same node.
+func (r *ClusterRouter) EnableStreamManagement(stm Stream) (Stream, string) {
+	return r.local.EnableStreamManagement(stm)
+}
+
+// HandleStreamManagement dispatches a XEP-0198 command to this node's
+// local Manager; see EnableStreamManagement for the clustering caveat.
+func (r *ClusterRouter) HandleStreamManagement(stm Stream, elem xml.XElement) (Stream, bool) {
+	return r.local.HandleStreamManagement(stm, elem)
+}
+
+// AckOutbound registers the client's acknowledgement of h against this
+// node's local session bookkeeping for stm.
+func (r *ClusterRouter) AckOutbound(stm Stream, h uint32) {
+	r.local.AckOutbound(stm, h)
+}
+
+// OutboundCount returns the current outbound stanza counter for stm, as
+// tracked by this node's local session bookkeeping.
+func (r *ClusterRouter) OutboundCount(stm Stream) uint32 {
+	return r.local.OutboundCount(stm)
+}
+
+// ResumeStream attempts to resume a session previously held on this same
+// node; see EnableStreamManagement for the clustering caveat.
+func (r *ClusterRouter) ResumeStream(newStm Stream, previd string, h uint32) (Stream, error) {
+	return r.local.ResumeStream(newStm, previd, h)
+}
+
+func (r *ClusterRouter) route(elem xml.Stanza, ignoreBlocking bool) error {
+	toJID := elem.ToJID()
+	if !r.IsLocalDomain(toJID.Domain()) {
+		if s2sRouter != nil {
+			return s2sRouter.Route(elem)
+		}
+		return nil
+	}
+	if !ignoreBlocking && !toJID.IsServer() && r.IsBlockedJID(elem.FromJID(), toJID.Node()) {
+		return ErrBlockedJID
+	}
+	notifyObservers(elem)
+
+	localStms := r.local.StreamsMatchingJID(toJID.ToBareJID())
+
+	lookupResource := ""
+	if toJID.IsFullWithUser() {
+		lookupResource = toJID.Resource()
+	}
+	remoteEntries, err := r.presence.Lookup(toJID.Node(), lookupResource)
+	if err != nil {
+		return err
+	}
+	remoteEntries = r.excludeLocalNode(remoteEntries)
+
+	if len(localStms) == 0 && len(remoteEntries) == 0 {
+		exists, err := storage.Instance().UserExists(toJID.Node())
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrNotAuthenticated
+		}
+		return ErrNotExistingAccount
+	}
+
+	if toJID.IsFullWithUser() {
+		// a full JID targets one specific resource — checking "does this
+		// user have any resource on this node" isn't enough, since that
+		// resource may live on another node entirely.
+		for _, stm := range localStms {
+			if stm.Resource() == toJID.Resource() {
+				stm.SendElement(elem)
+				return nil
+			}
+		}
+		for _, entry := range remoteEntries {
+			if entry.JID.Resource() == toJID.Resource() {
+				return r.forward(entry.NodeID, elem)
+			}
+		}
+		return ErrResourceNotFound
+	}
+
+	switch elem.(type) {
+	case *xml.Message:
+		// send toJID the highest-priority resource across the whole
+		// cluster, not just the ones hosted on this node.
+		stm, entry := r.highestPriority(localStms, remoteEntries)
+		switch {
+		case stm != nil:
+			stm.SendElement(elem)
+		case entry != nil:
+			return r.forward(entry.NodeID, elem)
+		}
+
+	default:
+		// broadcast toJID every local stream and every distinct remote
+		// node hosting one of this user's other resources.
+		for _, stm := range localStms {
+			stm.SendElement(elem)
+		}
+		seen := make(map[string]bool, len(remoteEntries))
+		for _, entry := range remoteEntries {
+			if seen[entry.NodeID] {
+				continue
+			}
+			seen[entry.NodeID] = true
+			if err := r.forwarder.Forward(entry.NodeID, elem); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+	return nil
+}
+
+// highestPriority picks the highest-priority destination across local
+// streams and remote presence entries, preferring the local stream on a
+// tie since it's already in hand. Both returns are nil if neither slice
+// has anything to offer.
+func (r *ClusterRouter) highestPriority(localStms []Stream, remoteEntries []PresenceEntry) (Stream, *PresenceEntry) {
+	var bestStm Stream
+	var bestPriority int8
+	for _, stm := range localStms {
+		var p int8
+		if pres := stm.Presence(); pres != nil {
+			p = pres.Priority()
+		}
+		if bestStm == nil || p > bestPriority {
+			bestStm = stm
+			bestPriority = p
+		}
+	}
+	var bestEntry *PresenceEntry
+	for i := range remoteEntries {
+		entry := &remoteEntries[i]
+		if bestStm != nil && entry.Priority <= bestPriority {
+			continue
+		}
+		if bestEntry == nil || entry.Priority > bestEntry.Priority {
+			bestEntry = entry
+		}
+	}
+	if bestEntry != nil && (bestStm == nil || bestEntry.Priority > bestPriority) {
+		return nil, bestEntry
+	}
+	return bestStm, nil
+}
+
+func (r *ClusterRouter) forward(nodeID string, elem xml.Stanza) error {
+	return r.forwarder.Forward(nodeID, elem)
+}
+
+// excludeLocalNode drops entries the presence store still reports under
+// this node's id, which StreamsMatchingJID/localStms already cover.
+func (r *ClusterRouter) excludeLocalNode(entries []PresenceEntry) []PresenceEntry {
+	var ret []PresenceEntry
+	for _, entry := range entries {
+		if entry.NodeID == r.nodeID {
+			continue
+		}
+		ret = append(ret, entry)
+	}
+	return ret
+}
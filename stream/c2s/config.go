@@ -0,0 +1,25 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package c2s
+
+// Config represents a C2S connection manager configuration.
+type Config struct {
+	Domains []string `yaml:"domains"`
+
+	// StreamManagement holds the XEP-0198 Stream Management configuration.
+	StreamManagement StreamManagementConfig `yaml:"stream_management"`
+}
+
+// StreamManagementConfig represents XEP-0198 Stream Management module configuration.
+type StreamManagementConfig struct {
+	// MaxQueueSize establishes the maximum number of unacknowledged outbound
+	// stanzas kept per stream before the oldest entries are discarded.
+	MaxQueueSize int `yaml:"max_queue_size"`
+
+	// ResumeTimeout establishes, in seconds, how long a disconnected but
+	// resumable session is held before being definitely evicted.
+	ResumeTimeout int `yaml:"resume_timeout"`
+}
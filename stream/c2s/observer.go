@@ -0,0 +1,42 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package c2s
+
+import (
+	"sync"
+
+	"github.com/ortuman/jackal/xml"
+)
+
+// StanzaObserver is notified of every stanza Route/MustRoute accepts for a
+// local domain, after the blocking list check but before delivery, without
+// taking part in delivery itself. Stanzas handed to the s2s router for a
+// non-local domain are not observed. module/xep0313 uses it to archive a
+// copy of each message in flight.
+type StanzaObserver interface {
+	ObserveStanza(elem xml.Stanza)
+}
+
+var (
+	observersMu sync.RWMutex
+	observers   []StanzaObserver
+)
+
+// RegisterStanzaObserver adds o to the set of observers notified of every
+// routed stanza. Call it once per observer during module setup.
+func RegisterStanzaObserver(o StanzaObserver) {
+	observersMu.Lock()
+	defer observersMu.Unlock()
+	observers = append(observers, o)
+}
+
+func notifyObservers(elem xml.Stanza) {
+	observersMu.RLock()
+	defer observersMu.RUnlock()
+	for _, o := range observers {
+		o.ObserveStanza(elem)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package c2s
+
+import "github.com/ortuman/jackal/xml"
+
+// Router abstracts the routing backend used by the c2s session manager,
+// letting RegisterStream, Route, StreamsMatchingJID and friends be answered
+// either by a single node's in-memory state (Manager) or by a cluster-aware
+// backend that shares presence across nodes (ClusterRouter).
+type Router interface {
+	DefaultLocalDomain() string
+	IsLocalDomain(domain string) bool
+
+	RegisterStream(stm Stream) error
+	UnregisterStream(stm Stream) error
+	AuthenticateStream(stm Stream) error
+
+	IsBlockedJID(jid *xml.JID, username string) bool
+	ReloadBlockList(username string)
+
+	Route(elem xml.Stanza) error
+	MustRoute(elem xml.Stanza) error
+
+	StreamsMatchingJID(jid *xml.JID) []Stream
+
+	// ResourcesMatchingJID returns every resource matching jid across the
+	// whole cluster, unlike StreamsMatchingJID which only ever sees this
+	// node's own connections. Use it for presence probes; it returns JIDs,
+	// not Streams, since a remote resource has no local Stream to send to.
+	ResourcesMatchingJID(jid *xml.JID) ([]*xml.JID, error)
+
+	// EnableStreamManagement, AckOutbound, OutboundCount and ResumeStream
+	// carry XEP-0198 stream management. On ClusterRouter these only ever
+	// see this node's own streams — a resumption can't be reclaimed on a
+	// different node than the one that originally held it, since the
+	// smSession buffer isn't replicated across the cluster. That's a real
+	// limitation of clustered deployments, not just an oversight: fixing
+	// it requires replicating the outbound buffer through PresenceStore
+	// (or a dedicated store) and is left for a follow-up.
+	EnableStreamManagement(stm Stream) (Stream, string)
+	HandleStreamManagement(stm Stream, elem xml.XElement) (Stream, bool)
+	AckOutbound(stm Stream, h uint32)
+	OutboundCount(stm Stream) uint32
+	ResumeStream(newStm Stream, previd string, h uint32) (Stream, error)
+}
+
+// PresenceEntry represents a single authenticated resource's location
+// within the cluster.
+type PresenceEntry struct {
+	JID    *xml.JID
+	NodeID string
+
+	// Priority is the resource's last known presence priority, used to
+	// pick a highest-priority-wins destination across nodes the same way
+	// Manager.route does locally via Stream.Presence(). It's only as
+	// fresh as the last Put call — nothing in this tree re-publishes it
+	// when a resource's presence changes after authentication, since
+	// presence handling itself lives outside this package.
+	Priority int8
+}
+
+// PresenceStore abstracts the cluster-wide table of which node is
+// currently hosting each authenticated resource. Implementations are
+// expected to be backed by something every node can reach — Redis, NATS or
+// a Raft-replicated log are all reasonable choices.
+type PresenceStore interface {
+	// Put advertises that username/resource is now hosted by nodeID, at
+	// the given presence priority.
+	Put(username, resource, nodeID string, priority int8) error
+
+	// Remove withdraws a previously advertised presence entry.
+	Remove(username, resource string) error
+
+	// Lookup returns every entry currently known for username. If
+	// resource is non-empty, only that resource's entry is returned.
+	Lookup(username, resource string) ([]PresenceEntry, error)
+
+	// Invalidate purges any state the store caches for username, so the
+	// next lookup re-fetches it. ClusterRouter.ReloadBlockList calls it on
+	// the node where username's block list was reloaded; the block list
+	// cache each node's Manager keeps is not reachable from here.
+	Invalidate(username string)
+}
+
+// NodeForwarder delivers a stanza to the node currently hosting its
+// destination resource, as located through a PresenceStore. Implementations
+// typically wrap a length-prefixed protobuf connection pool or an internal
+// s2s-style XMPP tunnel keyed by node id.
+type NodeForwarder interface {
+	Forward(nodeID string, elem xml.Stanza) error
+}
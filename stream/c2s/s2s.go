@@ -0,0 +1,27 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package c2s
+
+import "github.com/ortuman/jackal/xml"
+
+// S2SRouter abstracts outbound delivery to federated domains, so route
+// doesn't depend on the stream/s2s package directly. s2s.Router satisfies
+// this interface.
+type S2SRouter interface {
+	Route(elem xml.Stanza) error
+}
+
+// s2sRouter is the federation backend handed stanzas addressed to domains
+// IsLocalDomain doesn't recognize. Nil until SetS2SRouter is called, in
+// which case such stanzas are silently dropped, matching prior behavior.
+var s2sRouter S2SRouter
+
+// SetS2SRouter registers the backend used to deliver stanzas to non-local
+// domains. Call it once during server startup, after initializing the s2s
+// package.
+func SetS2SRouter(router S2SRouter) {
+	s2sRouter = router
+}
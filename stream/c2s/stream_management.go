@@ -0,0 +1,319 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package c2s
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/xml"
+)
+
+// smNamespace is the XEP-0198 Stream Management namespace every <enable/>,
+// <resume/>, <r/> and <a/> element arrives under.
+const smNamespace = "urn:xmpp:sm:3"
+
+// smSession tracks the XEP-0198 Stream Management state bound to an
+// authenticated stream: the outstanding outbound stanzas awaiting
+// acknowledgement, and, once the underlying transport goes away, the
+// resumption bookkeeping that allows a client to splice a new one in.
+type smSession struct {
+	resumeID  string
+	queue     *smQueue
+	stm       Stream
+	holdTimer *time.Timer
+}
+
+// smStream decorates a Stream once stream management has been enabled on
+// it, so that every subsequent SendElement call — whether it comes from
+// Manager.route or straight from an IQ module holding its own stm reference,
+// such as xep0077 — counts toward the outbound stanza index XEP-0198
+// resumption depends on. This is the single choke point outbound counting
+// goes through; a stream that hasn't been wrapped here is never counted.
+type smStream struct {
+	Stream
+	sess *smSession
+}
+
+// SendElement delivers elem over the underlying stream and, if it's a
+// stanza, buffers it for replay and bumps the outgoing counter.
+func (s *smStream) SendElement(elem xml.XElement) {
+	s.Stream.SendElement(elem)
+	if stanza, ok := elem.(xml.Stanza); ok {
+		s.sess.queue.Enqueue(stanza)
+	}
+}
+
+// HandleStreamManagement inspects elem and, if it's a XEP-0198 command
+// (<enable/>, <r/>, <a/> or <resume/>) addressed to stm, handles it
+// completely — replying with <enabled/>, <a/>, <resumed/> or <failed/> as
+// appropriate — and returns true. A caller's stream negotiation loop should
+// invoke this for every top-level element it reads, the same way
+// MatchesIQ/ProcessIQ are invoked for IQ modules, before handing unhandled
+// elements on to ordinary stanza dispatch.
+//
+// Enabling or resuming a session replaces the Stream the caller must use
+// for every subsequent send with the decorator returned alongside true;
+// callers MUST swap their held reference to it so direct SendElement calls
+// keep feeding the same outbound counter Manager.route uses.
+func (m *Manager) HandleStreamManagement(stm Stream, elem xml.XElement) (Stream, bool) {
+	if elem.Namespace() != smNamespace {
+		return stm, false
+	}
+	switch elem.Name() {
+	case "enable":
+		wrapped, resumeID := m.EnableStreamManagement(stm)
+		enabled := xml.NewElementNamespace("enabled", smNamespace)
+		if m.cfg.StreamManagement.ResumeTimeout > 0 {
+			enabled.SetAttribute("id", resumeID)
+			enabled.SetAttribute("resume", "true")
+		}
+		wrapped.SendElement(enabled)
+		return wrapped, true
+
+	case "r":
+		a := xml.NewElementNamespace("a", smNamespace)
+		a.SetAttribute("h", strconv.FormatUint(uint64(m.OutboundCount(stm)), 10))
+		stm.SendElement(a)
+		return stm, true
+
+	case "a":
+		if h, err := strconv.ParseUint(elem.Attributes().Get("h"), 10, 32); err == nil {
+			m.AckOutbound(stm, uint32(h))
+		}
+		return stm, true
+
+	case "resume":
+		previd := elem.Attributes().Get("previd")
+		h, _ := strconv.ParseUint(elem.Attributes().Get("h"), 10, 32)
+		wrapped, err := m.ResumeStream(stm, previd, uint32(h))
+		if err != nil {
+			failed := xml.NewElementNamespace("failed", smNamespace)
+			stm.SendElement(failed)
+			return stm, true
+		}
+		resumed := xml.NewElementNamespace("resumed", smNamespace)
+		resumed.SetAttribute("previd", previd)
+		resumed.SetAttribute("h", strconv.FormatUint(uint64(m.OutboundCount(wrapped)), 10))
+		wrapped.SendElement(resumed)
+		return wrapped, true
+	}
+	return stm, false
+}
+
+// EnableStreamManagement activates XEP-0198 stream management for stm,
+// returning the Stream the caller must use from now on for every send (see
+// smStream) alongside the resumption id the client must present, together
+// with the last acknowledged stanza index, in order to resume this session
+// later on.
+func (m *Manager) EnableStreamManagement(stm Stream) (Stream, string) {
+	resumeID := smNewResumeID()
+	sess := &smSession{
+		resumeID: resumeID,
+		queue:    newSMQueue(m.cfg.StreamManagement.MaxQueueSize),
+	}
+	wrapped := &smStream{Stream: stm, sess: sess}
+	sess.stm = wrapped
+
+	m.lock.Lock()
+	m.rebindStreamLocked(stm, wrapped)
+	m.smSessions[stm.ID()] = sess
+	m.lock.Unlock()
+
+	log.Infof("stream management enabled... (id: %s, resume: %s)", stm.ID(), resumeID)
+	return wrapped, resumeID
+}
+
+// AckOutbound registers the client's acknowledgement of h, discarding every
+// buffered stanza up to and including that index.
+func (m *Manager) AckOutbound(stm Stream, h uint32) {
+	m.lock.RLock()
+	sess := m.smSessions[stm.ID()]
+	m.lock.RUnlock()
+	if sess == nil {
+		return
+	}
+	sess.queue.Ack(h)
+}
+
+// OutboundCount returns the current outbound stanza counter for stm,
+// or zero if stream management is not enabled for it.
+func (m *Manager) OutboundCount(stm Stream) uint32 {
+	m.lock.RLock()
+	sess := m.smSessions[stm.ID()]
+	m.lock.RUnlock()
+	if sess == nil {
+		return 0
+	}
+	return sess.queue.LastH()
+}
+
+// ResumeStream splices newStm onto the session previously registered under
+// previd, replays every stanza sent after h that hasn't been acknowledged
+// yet, and rebinds the resource so StreamsMatchingJID keeps routing to it.
+// It returns the Stream the caller must use from now on (see smStream).
+// ErrStreamNotResumable is returned if previd doesn't match a held session.
+func (m *Manager) ResumeStream(newStm Stream, previd string, h uint32) (Stream, error) {
+	m.lock.Lock()
+	sess, ok := m.resumable[previd]
+	if !ok {
+		m.lock.Unlock()
+		return nil, ErrStreamNotResumable
+	}
+	delete(m.resumable, previd)
+	if sess.holdTimer != nil {
+		sess.holdTimer.Stop()
+	}
+	oldStm := sess.stm
+	wrapped := &smStream{Stream: newStm, sess: sess}
+	sess.stm = wrapped
+	m.smSessions[newStm.ID()] = sess
+
+	if authedStms := m.authedStms[oldStm.Username()]; authedStms != nil {
+		rebound := false
+		for i, stm := range authedStms {
+			if stm.Resource() == oldStm.Resource() {
+				authedStms[i] = wrapped
+				rebound = true
+				break
+			}
+		}
+		if !rebound {
+			m.authedStms[oldStm.Username()] = append(authedStms, wrapped)
+		}
+	} else {
+		m.authedStms[oldStm.Username()] = []Stream{wrapped}
+	}
+	m.stms[newStm.ID()] = wrapped
+	replay := sess.queue.Since(h)
+	m.lock.Unlock()
+
+	// replayed stanzas keep the counters they were buffered under, so they
+	// go straight to the new transport rather than through wrapped, which
+	// would enqueue them a second time.
+	for _, stanza := range replay {
+		newStm.SendElement(stanza)
+	}
+	log.Infof("resumed stream... (previd: %s, h: %d, replayed: %d)", previd, h, len(replay))
+	return wrapped, nil
+}
+
+// rebindStreamLocked replaces every registration of old with wrapped.
+// Callers must hold m.lock.
+func (m *Manager) rebindStreamLocked(old, wrapped Stream) {
+	if _, ok := m.stms[old.ID()]; ok {
+		m.stms[old.ID()] = wrapped
+	}
+	if res := old.Resource(); len(res) > 0 {
+		if authedStms := m.authedStms[old.Username()]; authedStms != nil {
+			for i, stm := range authedStms {
+				if stm.Resource() == res {
+					authedStms[i] = wrapped
+					break
+				}
+			}
+		}
+	}
+}
+
+// holdForResumption keeps sess available for a bounded amount of time so a
+// client can reclaim it via ResumeStream instead of losing the unacked
+// stanzas still sitting in its queue. Callers must hold m.lock.
+func (m *Manager) holdForResumption(sess *smSession) {
+	timeout := time.Duration(m.cfg.StreamManagement.ResumeTimeout) * time.Second
+	sess.holdTimer = time.AfterFunc(timeout, func() {
+		m.lock.Lock()
+		delete(m.resumable, sess.resumeID)
+		m.lock.Unlock()
+		log.Infof("resumable session expired... (resume: %s)", sess.resumeID)
+	})
+	m.resumable[sess.resumeID] = sess
+}
+
+func smNewResumeID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// smEntry pairs a buffered outbound stanza with the counter value it was
+// assigned when enqueued.
+type smEntry struct {
+	h      uint32
+	stanza xml.Stanza
+}
+
+// smQueue is a bounded ring buffer of unacknowledged outbound stanzas keyed
+// by the XEP-0198 outgoing counter h. Its methods are safe for simultaneous
+// use by multiple goroutines.
+type smQueue struct {
+	mu      sync.Mutex
+	items   []smEntry
+	maxSize int
+	h       uint32
+	acked   uint32
+}
+
+func newSMQueue(maxSize int) *smQueue {
+	return &smQueue{maxSize: maxSize}
+}
+
+// Enqueue appends stanza to the buffer and returns its assigned counter.
+func (q *smQueue) Enqueue(stanza xml.Stanza) uint32 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.h++
+	q.items = append(q.items, smEntry{h: q.h, stanza: stanza})
+	if q.maxSize > 0 && len(q.items) > q.maxSize {
+		q.items = q.items[len(q.items)-q.maxSize:]
+	}
+	return q.h
+}
+
+// Ack discards every buffered entry up to and including h.
+func (q *smQueue) Ack(h uint32) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if h <= q.acked {
+		return
+	}
+	q.acked = h
+	i := 0
+	for ; i < len(q.items); i++ {
+		if q.items[i].h > h {
+			break
+		}
+	}
+	q.items = q.items[i:]
+}
+
+// Since returns every buffered stanza with a counter greater than h, in the
+// order they were originally enqueued.
+func (q *smQueue) Since(h uint32) []xml.Stanza {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var ret []xml.Stanza
+	for _, it := range q.items {
+		if it.h > h {
+			ret = append(ret, it.stanza)
+		}
+	}
+	return ret
+}
+
+// LastH returns the most recently assigned outbound counter.
+func (q *smQueue) LastH() uint32 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.h
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package stream
+
+// This file is a migration shim for code not yet ported to the typed
+// ContextKey[T]/Get/Set API in context_keys.go. It reproduces the old
+// map[string]interface{}-backed behavior, footguns included — a type
+// mismatch still silently returns the zero value instead of reporting one,
+// which is exactly what the typed API exists to fix. Don't add new callers;
+// migrate the ones that remain instead.
+
+// SetObject stores within the context an object reference.
+//
+// Deprecated: create a ContextKey[T] with NewKey and use Set instead.
+func (ctx *Context) SetObject(object interface{}, key string) {
+	ctx.mu.Lock()
+	ctx.legacy[key] = object
+	ctx.mu.Unlock()
+}
+
+// Object retrieves from the context a previously stored object reference.
+//
+// Deprecated: create a ContextKey[T] with NewKey and use Get instead.
+func (ctx *Context) Object(key string) interface{} {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+	return ctx.legacy[key]
+}
+
+// SetString stores within the context an string value.
+//
+// Deprecated: create a ContextKey[string] with NewKey and use Set instead.
+func (ctx *Context) SetString(s string, key string) {
+	ctx.SetObject(s, key)
+}
+
+// String retrieves from the context a previously stored string value.
+//
+// Deprecated: create a ContextKey[string] with NewKey and use Get instead.
+func (ctx *Context) String(key string) string {
+	s, _ := ctx.Object(key).(string)
+	return s
+}
+
+// SetInt stores within the context an integer value.
+//
+// Deprecated: create a ContextKey[int] with NewKey and use Set instead.
+func (ctx *Context) SetInt(integer int, key string) {
+	ctx.SetObject(integer, key)
+}
+
+// Int retrieves from the context a previously stored integer value.
+//
+// Deprecated: create a ContextKey[int] with NewKey and use Get instead.
+func (ctx *Context) Int(key string) int {
+	i, _ := ctx.Object(key).(int)
+	return i
+}
+
+// SetFloat stores within the context a floating point value.
+//
+// Deprecated: create a ContextKey[float64] with NewKey and use Set instead.
+func (ctx *Context) SetFloat(float float64, key string) {
+	ctx.SetObject(float, key)
+}
+
+// Float retrieves from the context a previously stored floating point value.
+//
+// Deprecated: create a ContextKey[float64] with NewKey and use Get instead.
+func (ctx *Context) Float(key string) float64 {
+	f, _ := ctx.Object(key).(float64)
+	return f
+}
+
+// SetBool stores within the context a boolean value.
+//
+// Deprecated: create a ContextKey[bool] with NewKey and use Set instead.
+func (ctx *Context) SetBool(boolean bool, key string) {
+	ctx.SetObject(boolean, key)
+}
+
+// Bool retrieves from the context a previously stored boolean value.
+//
+// Deprecated: create a ContextKey[bool] with NewKey and use Get instead.
+func (ctx *Context) Bool(key string) bool {
+	b, _ := ctx.Object(key).(bool)
+	return b
+}
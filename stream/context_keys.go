@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package stream
+
+// ContextKey identifies a typed value stored in a Context. Create one with
+// NewKey and reuse it — it's the accessor for that value everywhere, and
+// its type parameter is checked by the compiler at every Get/Set call
+// site, so a module can no longer fetch a key under the wrong type.
+//
+// Two keys are distinct even if created with the same name: identity comes
+// from id, not name, so colliding names across unrelated modules can't
+// make them alias the same slot the way the untyped API's string keys
+// could.
+type ContextKey[T any] struct {
+	id   *byte
+	name string
+}
+
+// NewKey returns a new typed context key. name is used only for
+// diagnostics; it has no bearing on the key's identity.
+func NewKey[T any](name string) ContextKey[T] {
+	return ContextKey[T]{id: new(byte), name: name}
+}
+
+// String returns the key's diagnostic name.
+func (k ContextKey[T]) String() string {
+	return k.name
+}
+
+// Get retrieves the value stored in ctx under key. The second return value
+// reports whether a value was actually present, distinguishing "never
+// set" from a stored zero value — unlike the deprecated untyped
+// accessors, which return a zero value for both and for a type mismatch.
+func Get[T any](ctx *Context, key ContextKey[T]) (T, bool) {
+	var zero T
+	v, ok := ctx.get(key.id)
+	if !ok {
+		return zero, false
+	}
+	typed, ok := v.(T)
+	if !ok {
+		return zero, false
+	}
+	return typed, true
+}
+
+// Set stores val in ctx under key.
+func Set[T any](ctx *Context, key ContextKey[T], val T) {
+	ctx.set(key.id, val)
+}
+
+// DoOnceValue behaves like Context.DoOnce but additionally caches f's
+// result under key, so every caller — regardless of which one happened to
+// run first — observes the same computed value instead of merely
+// skipping re-execution.
+func DoOnceValue[T any](ctx *Context, key ContextKey[T], f func() T) T {
+	ctx.doOnce(key.id, func() {
+		Set(ctx, key, f())
+	})
+	v, _ := Get(ctx, key)
+	return v
+}
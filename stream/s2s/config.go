@@ -0,0 +1,23 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package s2s
+
+// Config represents the server-to-server (s2s) federation subsystem
+// configuration.
+type Config struct {
+	// DialbackSecret signs and verifies XEP-0220 dialback keys, used as a
+	// fallback whenever SASL EXTERNAL certificate verification isn't
+	// available for an outbound connection.
+	DialbackSecret string `yaml:"dialback_secret"`
+
+	// ConnectTimeout establishes, in seconds, how long to wait for an
+	// outbound connection to complete before giving up.
+	ConnectTimeout int `yaml:"connect_timeout"`
+
+	// MaxIdleTime establishes, in seconds, how long an outbound connection
+	// may sit unused before being closed.
+	MaxIdleTime int `yaml:"max_idle_time"`
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package s2s
+
+import (
+	"crypto/tls"
+	stdxml "encoding/xml"
+	"fmt"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/xml"
+)
+
+// outConn represents an established, authenticated outbound s2s connection
+// to a single remote domain. A connection is multiplexed: once dialback or
+// SASL EXTERNAL succeeds for the first local<->remote domain pair sharing
+// this remote domain, further pairs piggyback on the same connection.
+type outConn struct {
+	domain        string
+	conn          *tls.Conn
+	dec           *stdxml.Decoder // decoder established during the post-STARTTLS handshake, reused by monitor
+	verifiedPairs map[string]bool // "local|remote" domain pairs verified over conn
+}
+
+// Send serializes and writes elem to the underlying TLS connection.
+func (c *outConn) Send(elem xml.Stanza) error {
+	_, err := fmt.Fprint(c.conn, elem.String())
+	return err
+}
+
+// Close tears down the underlying connection.
+func (c *outConn) Close() error {
+	return c.conn.Close()
+}
+
+// monitor reads from the connection until it errors, the peer closes the
+// stream, or a <stream:error/> arrives, then invokes onLost so the owning
+// pool stops writing to a dead socket. It's the connection's only reader:
+// without it, a peer-initiated close or stream error was invisible until
+// the next failed Send, by which point stanzas had already been written
+// into a socket nobody noticed was gone.
+func (c *outConn) monitor(onLost func()) {
+loop:
+	for {
+		tok, err := c.dec.Token()
+		if err != nil {
+			log.Infof("s2s: connection to %s closed: %v", c.domain, err)
+			break loop
+		}
+		switch t := tok.(type) {
+		case stdxml.EndElement:
+			if t.Name.Local == "stream" {
+				log.Infof("s2s: peer %s closed the stream", c.domain)
+				break loop
+			}
+		case stdxml.StartElement:
+			if t.Name.Local == "error" {
+				log.Errorf("s2s: stream error from %s", c.domain)
+				break loop
+			}
+		}
+	}
+	c.Close()
+	onLost()
+}
@@ -0,0 +1,300 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package s2s
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	stdxml "encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	streamNamespace   = "jabber:server"
+	dialbackNamespace = "jabber:server:dialback"
+	saslNamespace     = "urn:ietf:params:xml:ns:xmpp-sasl"
+	tlsFeatNamespace  = "urn:ietf:params:xml:ns:xmpp-tls"
+)
+
+// streamFeatures records what the peer advertised in <stream:features/>.
+type streamFeatures struct {
+	startTLS     bool
+	saslExternal bool
+	dialback     bool
+}
+
+// dialAndAuthenticate opens a TCP connection to target on behalf of domain,
+// negotiates STARTTLS and restarts the stream over the resulting encrypted
+// channel, then authenticates it via SASL EXTERNAL (certificate-based
+// domain verification) when the peer's certificate covers domain, falling
+// back to XEP-0220 dialback otherwise.
+func dialAndAuthenticate(domain, target string, cfg *Config) (*outConn, error) {
+	timeout := time.Duration(cfg.ConnectTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 15 * time.Second
+	}
+	rawConn, err := net.DialTimeout("tcp", target, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", target, err)
+	}
+	_ = rawConn.SetDeadline(time.Now().Add(timeout))
+
+	// A single *xml.Decoder is reused for every step sharing the same
+	// underlying connection: the Decoder buffers ahead of the token it
+	// hands back, so dropping it between steps (e.g. between openStream
+	// and negotiateStartTLS) discards whatever it already read past the
+	// current token, which stalls or breaks the handshake against any
+	// peer that doesn't pace writes to exactly match step boundaries.
+	rawDec := stdxml.NewDecoder(rawConn)
+	_, features, err := openStream(rawConn, rawDec, domain, target)
+	if err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	if !features.startTLS {
+		rawConn.Close()
+		return nil, fmt.Errorf("s2s: %s does not offer starttls", target)
+	}
+	if err := negotiateStartTLS(rawConn, rawDec); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+
+	tlsConn := tls.Client(rawConn, &tls.Config{ServerName: domain})
+	if err := tlsConn.Handshake(); err != nil {
+		tlsConn.Close()
+		return nil, fmt.Errorf("tls handshake with %s: %w", target, err)
+	}
+
+	// XMPP requires restarting the stream after STARTTLS, now over the
+	// encrypted channel, before features (and the SASL mechanisms they
+	// list) can be trusted. The TLS channel is a genuinely new byte
+	// stream, so it gets its own decoder, shared in turn by the restart
+	// and whichever authentication step follows.
+	tlsDec := stdxml.NewDecoder(tlsConn)
+	streamID, features, err := openStream(tlsConn, tlsDec, domain, target)
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+
+	if features.saslExternal && verifyCertificateDomain(tlsConn, domain) {
+		if err := authenticateSASLExternal(tlsConn, tlsDec); err != nil {
+			tlsConn.Close()
+			return nil, fmt.Errorf("sasl external with %s: %w", target, err)
+		}
+	} else {
+		if len(cfg.DialbackSecret) == 0 {
+			tlsConn.Close()
+			return nil, fmt.Errorf("cannot authenticate to %s: certificate doesn't match and dialback is disabled", domain)
+		}
+		key := generateDialbackKey(cfg.DialbackSecret, domain, target, streamID)
+		if err := authenticateDialback(tlsConn, tlsDec, domain, target, key); err != nil {
+			tlsConn.Close()
+			return nil, fmt.Errorf("dialback with %s: %w", target, err)
+		}
+	}
+	_ = rawConn.SetDeadline(time.Time{})
+
+	return &outConn{
+		domain:        domain,
+		conn:          tlsConn,
+		dec:           tlsDec,
+		verifiedPairs: map[string]bool{domain + "|" + target: true},
+	}, nil
+}
+
+// openStream writes a <stream:stream> header to conn on behalf of from,
+// addressed to to, then reads the peer's reply up to and including
+// </stream:features> off dec, returning the stream id the peer assigned
+// alongside what it offered. dec must be reused across every step sharing
+// conn's underlying byte stream, since it buffers ahead of the token it
+// returns.
+func openStream(conn io.Writer, dec *stdxml.Decoder, from, to string) (string, streamFeatures, error) {
+	_, err := fmt.Fprintf(conn,
+		"<?xml version='1.0'?><stream:stream xmlns='%s' xmlns:stream='http://etherx.jabber.org/streams' xmlns:db='%s' from='%s' to='%s' version='1.0'>",
+		streamNamespace, dialbackNamespace, from, to)
+	if err != nil {
+		return "", streamFeatures{}, fmt.Errorf("s2s: write stream header: %w", err)
+	}
+
+	var id string
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return "", streamFeatures{}, fmt.Errorf("s2s: read stream header: %w", err)
+		}
+		start, ok := tok.(stdxml.StartElement)
+		if !ok || start.Name.Local != "stream" {
+			continue
+		}
+		for _, attr := range start.Attr {
+			if attr.Name.Local == "id" {
+				id = attr.Value
+			}
+		}
+		break
+	}
+
+	features, err := readFeatures(dec)
+	if err != nil {
+		return "", streamFeatures{}, err
+	}
+	return id, features, nil
+}
+
+// readFeatures consumes tokens up to and including </stream:features>,
+// recording what the peer advertised.
+func readFeatures(dec *stdxml.Decoder) (streamFeatures, error) {
+	var features streamFeatures
+	inMechanisms := false
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return streamFeatures{}, fmt.Errorf("s2s: read stream features: %w", err)
+		}
+		switch t := tok.(type) {
+		case stdxml.StartElement:
+			switch {
+			case t.Name.Local == "starttls" && t.Name.Space == tlsFeatNamespace:
+				features.startTLS = true
+			case t.Name.Local == "dialback" && t.Name.Space == dialbackNamespace:
+				features.dialback = true
+			case t.Name.Local == "mechanisms" && t.Name.Space == saslNamespace:
+				inMechanisms = true
+			case t.Name.Local == "mechanism":
+				// handled via the following CharData token
+			}
+		case stdxml.CharData:
+			if inMechanisms && string(t) == "EXTERNAL" {
+				features.saslExternal = true
+			}
+		case stdxml.EndElement:
+			switch t.Name.Local {
+			case "mechanisms":
+				inMechanisms = false
+			case "features":
+				return features, nil
+			}
+		}
+	}
+}
+
+// negotiateStartTLS requests STARTTLS and waits for the peer's <proceed/>
+// off dec, which must be the same decoder used to read conn's stream
+// header and features.
+func negotiateStartTLS(conn io.Writer, dec *stdxml.Decoder) error {
+	if _, err := fmt.Fprintf(conn, "<starttls xmlns='%s'/>", tlsFeatNamespace); err != nil {
+		return fmt.Errorf("s2s: write starttls: %w", err)
+	}
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("s2s: read starttls response: %w", err)
+		}
+		start, ok := tok.(stdxml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "proceed":
+			return nil
+		case "failure":
+			return fmt.Errorf("s2s: peer refused starttls")
+		}
+	}
+}
+
+// authenticateSASLExternal performs the one-shot SASL EXTERNAL exchange,
+// relying on the certificate verification the caller already performed.
+// dec must be the same decoder used to read conn's post-STARTTLS stream
+// header and features.
+func authenticateSASLExternal(conn io.Writer, dec *stdxml.Decoder) error {
+	if _, err := fmt.Fprintf(conn, "<auth xmlns='%s' mechanism='EXTERNAL'>=</auth>", saslNamespace); err != nil {
+		return fmt.Errorf("s2s: write sasl auth: %w", err)
+	}
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("s2s: read sasl response: %w", err)
+		}
+		start, ok := tok.(stdxml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "success":
+			return nil
+		case "failure":
+			return fmt.Errorf("s2s: sasl external rejected")
+		}
+	}
+}
+
+// authenticateDialback sends the XEP-0220 <db:result/> carrying key and
+// waits for the peer's verdict off dec, which must be the same decoder
+// used to read conn's post-STARTTLS stream header and features.
+func authenticateDialback(conn io.Writer, dec *stdxml.Decoder, from, to, key string) error {
+	if _, err := fmt.Fprintf(conn, "<db:result from='%s' to='%s'>%s</db:result>", from, to, key); err != nil {
+		return fmt.Errorf("s2s: write dialback result: %w", err)
+	}
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("s2s: read dialback response: %w", err)
+		}
+		start, ok := tok.(stdxml.StartElement)
+		if !ok || start.Name.Local != "result" {
+			continue
+		}
+		for _, attr := range start.Attr {
+			if attr.Name.Local != "type" {
+				continue
+			}
+			if attr.Value == "valid" {
+				return nil
+			}
+			return fmt.Errorf("s2s: dialback rejected (type=%s)", attr.Value)
+		}
+		return fmt.Errorf("s2s: dialback response missing type attribute")
+	}
+}
+
+// verifyCertificateDomain reports whether conn's peer certificate covers
+// domain, satisfying SASL EXTERNAL's certificate-based domain verification.
+func verifyCertificateDomain(conn *tls.Conn, domain string) bool {
+	for _, chain := range conn.ConnectionState().VerifiedChains {
+		if len(chain) == 0 {
+			continue
+		}
+		if err := chain[0].VerifyHostname(domain); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// generateDialbackKey derives the XEP-0220 dialback key authenticating
+// origin to target for the given stream id, using cfg's shared secret.
+func generateDialbackKey(secret, origin, target, streamID string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(origin + " " + target + " " + streamID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyDialbackKey reports whether key matches the one generateDialbackKey
+// would have produced for the same parameters, the check the receiving
+// side of dialback makes on a <db:result/> from a peer claiming to be
+// origin. Nothing in this package calls it: the package only initiates
+// outbound connections and has no inbound accept side.
+func verifyDialbackKey(secret, origin, target, streamID, key string) bool {
+	return hmac.Equal([]byte(key), []byte(generateDialbackKey(secret, origin, target, streamID)))
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package s2s
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/xml"
+)
+
+// maxDialAttempts bounds how many times dialAttempt retries a failed dial
+// before giving up on the stanzas queued for it. Without a cap, a
+// permanently unreachable domain would retry forever; without retrying at
+// all, a single transient failure would drop every queued stanza silently.
+const maxDialAttempts = 3
+
+// connPool manages the outbound connection to a single remote domain,
+// queuing stanzas while dialback/SASL EXTERNAL negotiation is in flight
+// and evicting the connection after cfg.MaxIdleTime of inactivity. A single
+// connection piggybacks every local<->remote domain pair routed toward the
+// same remote domain.
+type connPool struct {
+	domain string
+	cfg    *Config
+
+	mu        sync.Mutex
+	conn      *outConn
+	pending   []xml.Stanza
+	idleTimer *time.Timer
+}
+
+func newConnPool(domain string, cfg *Config) *connPool {
+	return &connPool{domain: domain, cfg: cfg}
+}
+
+// Enqueue writes elem to the pool's established connection, or queues it
+// and kicks off connection establishment if none exists yet.
+func (p *connPool) Enqueue(elem xml.Stanza) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn != nil {
+		p.resetIdleTimerLocked()
+		return p.conn.Send(elem)
+	}
+	p.pending = append(p.pending, elem)
+	if len(p.pending) == 1 {
+		go p.dial()
+	}
+	return nil
+}
+
+func (p *connPool) dial() {
+	p.dialAttempt(1)
+}
+
+// dialAttempt tries to establish and authenticate a connection, retrying
+// with a linear backoff up to maxDialAttempts before giving up and
+// reporting how many queued stanzas were dropped as a result — a transient
+// failure no longer silently discards an entire backlog on the first try.
+func (p *connPool) dialAttempt(attempt int) {
+	target, err := resolveRemoteDomain(p.domain)
+	if err == nil {
+		var conn *outConn
+		if conn, err = dialAndAuthenticate(p.domain, target, p.cfg); err == nil {
+			p.mu.Lock()
+			p.conn = conn
+			pending := p.pending
+			p.pending = nil
+			p.resetIdleTimerLocked()
+			p.mu.Unlock()
+
+			go conn.monitor(p.connLost)
+
+			for _, elem := range pending {
+				if err := conn.Send(elem); err != nil {
+					log.Error(err)
+				}
+			}
+			return
+		}
+	}
+
+	log.Errorf("s2s: dial attempt %d/%d to %s failed: %v", attempt, maxDialAttempts, p.domain, err)
+	if attempt >= maxDialAttempts {
+		p.dropPending(attempt)
+		return
+	}
+	time.AfterFunc(time.Duration(attempt)*time.Second, func() {
+		p.dialAttempt(attempt + 1)
+	})
+}
+
+// connLost clears the pool's connection once monitor observes it die, so
+// the next Enqueue dials a fresh one instead of writing into a dead socket.
+func (p *connPool) connLost() {
+	p.mu.Lock()
+	p.conn = nil
+	p.mu.Unlock()
+}
+
+func (p *connPool) dropPending(attempts int) {
+	p.mu.Lock()
+	dropped := len(p.pending)
+	p.pending = nil
+	p.mu.Unlock()
+	if dropped > 0 {
+		log.Errorf("s2s: dropping %d stanza(s) queued for %s after %d failed dial attempt(s)", dropped, p.domain, attempts)
+	}
+}
+
+// resetIdleTimerLocked restarts the eviction timer. Callers must hold p.mu.
+func (p *connPool) resetIdleTimerLocked() {
+	if p.idleTimer != nil {
+		p.idleTimer.Stop()
+	}
+	if p.cfg.MaxIdleTime <= 0 {
+		return
+	}
+	timeout := time.Duration(p.cfg.MaxIdleTime) * time.Second
+	p.idleTimer = time.AfterFunc(timeout, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.conn != nil {
+			_ = p.conn.Close()
+			p.conn = nil
+		}
+	})
+}
+
+// resolveRemoteDomain resolves the _xmpp-server._tcp SRV records for
+// domain, falling back to a direct lookup on the standard s2s port when
+// none are published.
+func resolveRemoteDomain(domain string) (string, error) {
+	_, addrs, err := net.LookupSRV("xmpp-server", "tcp", domain)
+	if err == nil && len(addrs) > 0 {
+		return fmt.Sprintf("%s:%d", addrs[0].Target, addrs[0].Port), nil
+	}
+	return fmt.Sprintf("%s:5269", domain), nil
+}
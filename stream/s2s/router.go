@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+// Package s2s implements the server-to-server (federation) side of the
+// XMPP stream, mirroring stream/c2s but for outbound connections to remote
+// domains: XEP-0220 dialback, SASL EXTERNAL over TLS, DNS SRV resolution
+// and per-domain connection pooling all live here.
+package s2s
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/xml"
+)
+
+// Router dials, authenticates and multiplexes outbound XMPP federation
+// connections, queuing stanzas for domains that don't have an established
+// connection yet. It satisfies c2s.S2SRouter, so c2s.Manager can hand it
+// stanzas addressed to non-local domains.
+type Router struct {
+	cfg   *Config
+	lock  sync.RWMutex
+	pools map[string]*connPool // keyed by remote domain
+}
+
+// singleton interface
+var (
+	inst        *Router
+	instMu      sync.RWMutex
+	initialized uint32
+)
+
+// Initialize initializes the s2s federation router.
+func Initialize(cfg *Config) {
+	if atomic.CompareAndSwapUint32(&initialized, 0, 1) {
+		instMu.Lock()
+		defer instMu.Unlock()
+
+		inst = &Router{
+			cfg:   cfg,
+			pools: make(map[string]*connPool),
+		}
+	}
+}
+
+// Instance returns the s2s federation router instance.
+func Instance() *Router {
+	instMu.RLock()
+	defer instMu.RUnlock()
+
+	if inst == nil {
+		log.Fatalf("s2s router not initialized")
+	}
+	return inst
+}
+
+// Shutdown shuts down the s2s federation router.
+// This method should be used only for testing purposes.
+func Shutdown() {
+	if atomic.CompareAndSwapUint32(&initialized, 1, 0) {
+		instMu.Lock()
+		defer instMu.Unlock()
+		inst = nil
+	}
+}
+
+// Route resolves the remote domain of elem's destination and writes it to
+// the corresponding outbound connection, dialing and authenticating one
+// (dialback or SASL EXTERNAL) if none exists yet. Stanzas submitted before
+// the connection is ready are queued and flushed once it comes up.
+func (r *Router) Route(elem xml.Stanza) error {
+	domain := elem.ToJID().Domain()
+	return r.poolFor(domain).Enqueue(elem)
+}
+
+func (r *Router) poolFor(domain string) *connPool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	p, ok := r.pools[domain]
+	if !ok {
+		p = newConnPool(domain, r.cfg)
+		r.pools[domain] = p
+	}
+	return p
+}